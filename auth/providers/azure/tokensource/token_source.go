@@ -0,0 +1,204 @@
+/*
+Copyright The Guard Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tokensource provides Azure AD token acquisition for guard's Azure
+// authorization provider, built on azidentity rather than the deprecated
+// go-autorest token providers.
+//
+// This is a leaf package (no guard imports of its own) so that both the
+// higher-level auth/providers/azure authorizer and the lower-level
+// util/azure discovery code can depend on it without creating a cycle
+// between those two.
+package tokensource
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CredentialKind selects which azidentity credential backs a TokenSource.
+type CredentialKind string
+
+const (
+	// CredentialKindWorkloadIdentity exchanges the pod's projected service
+	// account token for an Azure AD token (AKS workload identity / federated
+	// OIDC).
+	CredentialKindWorkloadIdentity CredentialKind = "workloadidentity"
+	// CredentialKindManagedIdentity uses the node or user-assigned managed
+	// identity.
+	CredentialKindManagedIdentity CredentialKind = "managedidentity"
+	// CredentialKindChained tries workload identity first and falls back to
+	// managed identity; this is the default so guard works unmodified on
+	// both AKS pod-identity styles.
+	CredentialKindChained CredentialKind = "chained"
+)
+
+// tokenRefreshSkew is how long before a cached token's expiry TokenSource
+// proactively refetches it instead of serving it from cache.
+const tokenRefreshSkew = 5 * time.Minute
+
+var (
+	tokenAcquisitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "guard_azure_token_acquisitions_total",
+		Help: "Number of Azure AD tokens acquired from a credential, labelled by credential kind.",
+	}, []string{"credential_kind"})
+
+	tokenCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "guard_azure_token_cache_hits_total",
+		Help: "Number of times a TokenSource served a still-valid cached token instead of acquiring a new one.",
+	})
+
+	tokenAcquisitionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "guard_azure_token_acquisition_failures_total",
+		Help: "Number of failed Azure AD token acquisitions, labelled by credential kind.",
+	}, []string{"credential_kind"})
+)
+
+func init() {
+	prometheus.MustRegister(tokenAcquisitionsTotal, tokenCacheHitsTotal, tokenAcquisitionFailuresTotal)
+}
+
+// TokenSourceOptions configures NewTokenSource.
+type TokenSourceOptions struct {
+	// CredentialKind selects the azidentity credential. Defaults to
+	// CredentialKindChained if empty.
+	CredentialKind CredentialKind
+	// Scope is the OAuth2 scope requested, e.g.
+	// "https://management.azure.com/.default".
+	Scope string
+	// UserAssignedIdentityClientID selects a user-assigned managed identity;
+	// leave empty for the system-assigned identity.
+	UserAssignedIdentityClientID string
+	// ClientOptions is threaded through to azidentity so the requests it
+	// makes during token acquisition get guard's configured retry policy,
+	// transport and telemetry.
+	ClientOptions policy.ClientOptions
+}
+
+// TokenSource acquires Azure AD bearer tokens for ARM calls, refetching the
+// cached token once it is within tokenRefreshSkew of expiry. The refetch runs
+// synchronously inside the Token call that finds the cached token stale.
+type TokenSource struct {
+	cred           azcore.TokenCredential
+	credentialKind CredentialKind
+	scope          string
+
+	mu     sync.Mutex
+	cached azcore.AccessToken
+}
+
+// NewTokenSource builds a TokenSource for opts.
+func NewTokenSource(opts TokenSourceOptions) (*TokenSource, error) {
+	kind := opts.CredentialKind
+	if kind == "" {
+		kind = CredentialKindChained
+	}
+
+	cred, err := newCredential(kind, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenSourceWithCredential(cred, kind, opts.Scope), nil
+}
+
+// NewTokenSourceWithCredential wraps an already-constructed
+// azcore.TokenCredential in a TokenSource. credentialKind is only used to
+// label the guard_azure_token_* metrics; use one of the CredentialKind
+// constants or a short descriptive string of your own, e.g. "clientsecret"
+// for the client secret flow ARC clusters use.
+func NewTokenSourceWithCredential(cred azcore.TokenCredential, credentialKind CredentialKind, scope string) *TokenSource {
+	return &TokenSource{cred: cred, credentialKind: credentialKind, scope: scope}
+}
+
+func newCredential(kind CredentialKind, opts TokenSourceOptions) (azcore.TokenCredential, error) {
+	switch kind {
+	case CredentialKindWorkloadIdentity:
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: opts.ClientOptions,
+		})
+	case CredentialKindManagedIdentity:
+		miOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: opts.ClientOptions}
+		if opts.UserAssignedIdentityClientID != "" {
+			miOpts.ID = azidentity.ClientID(opts.UserAssignedIdentityClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(miOpts)
+	case CredentialKindChained:
+		return newChainedCredential(opts)
+	default:
+		return nil, errors.Errorf("unsupported Azure credential kind %q", kind)
+	}
+}
+
+// newChainedCredential builds a ChainedTokenCredential trying workload
+// identity before managed identity. A credential is only omitted from the
+// chain if its constructor fails outright (e.g. the workload identity env
+// vars aren't set on this cluster); ChainedTokenCredential itself already
+// handles a credential being present but unable to get a token at request
+// time.
+func newChainedCredential(opts TokenSourceOptions) (azcore.TokenCredential, error) {
+	var creds []azcore.TokenCredential
+
+	if workload, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+		ClientOptions: opts.ClientOptions,
+	}); err == nil {
+		creds = append(creds, workload)
+	}
+
+	miOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: opts.ClientOptions}
+	if opts.UserAssignedIdentityClientID != "" {
+		miOpts.ID = azidentity.ClientID(opts.UserAssignedIdentityClientID)
+	}
+	if managed, err := azidentity.NewManagedIdentityCredential(miOpts); err == nil {
+		creds = append(creds, managed)
+	}
+
+	if len(creds) == 0 {
+		return nil, errors.New("no usable Azure credential: neither workload identity nor managed identity could be constructed")
+	}
+
+	return azidentity.NewChainedTokenCredential(creds, nil)
+}
+
+// Token returns a bearer token for ts's scope, serving the cached token when
+// it is still within its validity window and otherwise acquiring a new one.
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.cached.Token != "" && time.Until(ts.cached.ExpiresOn) > tokenRefreshSkew {
+		tokenCacheHitsTotal.Inc()
+		return ts.cached.Token, nil
+	}
+
+	tok, err := ts.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{ts.scope}})
+	if err != nil {
+		tokenAcquisitionFailuresTotal.WithLabelValues(string(ts.credentialKind)).Inc()
+		return "", errors.Wrap(err, "Failed to acquire Azure AD token")
+	}
+
+	tokenAcquisitionsTotal.WithLabelValues(string(ts.credentialKind)).Inc()
+	ts.cached = tok
+
+	return tok.Token, nil
+}
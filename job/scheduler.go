@@ -0,0 +1,375 @@
+/*
+Copyright The Guard Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package job owns the periodic background sync of guard's OperationsMap:
+// an initial sync at boot, a fast retry loop while the apiserver or Azure
+// are erroring, and a steady interval once healthy. When guard runs multiple
+// replicas, only the elected leader performs the (rate-limited) Azure
+// Get-Operations calls; the rest follow along by watching a ConfigMap the
+// leader publishes the result to.
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+
+	"go.kubeguard.dev/guard/util/azure"
+)
+
+const (
+	// DefaultFastRetryInterval is how often the scheduler retries a sync
+	// that failed, before it has ever succeeded or while it keeps failing.
+	DefaultFastRetryInterval = 30 * time.Second
+
+	// DefaultSteadyInterval is how often the scheduler resyncs once a sync
+	// has succeeded.
+	DefaultSteadyInterval = 30 * time.Minute
+
+	contentHashAnnotation = "guard.kubeguard.dev/operations-map-hash"
+	operationsMapDataKey  = "operationsMap"
+)
+
+var (
+	lastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "guard_discover_resources_last_success_timestamp",
+		Help: "Unix timestamp of the last successful OperationsMap sync (own sync if leader, ConfigMap observation if follower).",
+	})
+
+	isLeaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "guard_discover_resources_leader",
+		Help: "1 if this replica is the elected leader performing Azure Get-Operations calls, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(lastSuccessTimestamp, isLeaderGauge)
+}
+
+// RefreshFunc performs one OperationsMap rebuild, returning the result to
+// publish, e.g. a closure calling azure.DiscoverResources with fixed
+// settings.
+type RefreshFunc func(ctx context.Context) (azure.OperationsMap, error)
+
+// SchedulerOptions configures NewScheduler.
+type SchedulerOptions struct {
+	// Refresh performs the actual OperationsMap rebuild; only ever invoked
+	// on the leader.
+	Refresh RefreshFunc
+
+	// Namespace and ConfigMapName identify where the leader publishes its
+	// OperationsMap and where followers watch for it. Namespace is also
+	// used for the leader election lock.
+	Namespace     string
+	ConfigMapName string
+
+	// LockName is the leaderelection Lease name; Identity distinguishes
+	// this replica (typically the pod name).
+	LockName string
+	Identity string
+
+	// FastRetryInterval and SteadyInterval override the defaults above;
+	// values <= 0 fall back to the default.
+	FastRetryInterval time.Duration
+	SteadyInterval    time.Duration
+}
+
+// Scheduler runs the periodic OperationsMap sync described in the package
+// doc comment.
+type Scheduler struct {
+	opts          SchedulerOptions
+	kubeclientset kubernetes.Interface
+
+	mu       sync.RWMutex
+	snapshot azure.OperationsMap
+	isLeader bool
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	cancel   context.CancelFunc
+}
+
+// NewScheduler builds a Scheduler. kubeclientset is used both for leader
+// election (a Lease in opts.Namespace) and for reading/writing the
+// published ConfigMap.
+func NewScheduler(kubeclientset kubernetes.Interface, opts SchedulerOptions) (*Scheduler, error) {
+	if opts.Refresh == nil {
+		return nil, errors.New("job: SchedulerOptions.Refresh must not be nil")
+	}
+	if opts.Namespace == "" || opts.ConfigMapName == "" || opts.LockName == "" || opts.Identity == "" {
+		return nil, errors.New("job: Namespace, ConfigMapName, LockName and Identity are all required")
+	}
+
+	if opts.FastRetryInterval <= 0 {
+		opts.FastRetryInterval = DefaultFastRetryInterval
+	}
+	if opts.SteadyInterval <= 0 {
+		opts.SteadyInterval = DefaultSteadyInterval
+	}
+
+	return &Scheduler{
+		opts:          opts,
+		kubeclientset: kubeclientset,
+		snapshot:      azure.NewOperationsMap(),
+		stopCh:        make(chan struct{}),
+	}, nil
+}
+
+// Snapshot returns the most recently known OperationsMap: the leader's own
+// last successful sync, or the last ConfigMap update observed by a follower.
+func (s *Scheduler) Snapshot() azure.OperationsMap {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot
+}
+
+// Start runs the leader election loop and the ConfigMap-following watch
+// until ctx is cancelled or Stop is called. It does not block: both run in
+// background goroutines.
+func (s *Scheduler) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		s.opts.Namespace,
+		s.opts.LockName,
+		s.kubeclientset.CoreV1(),
+		s.kubeclientset.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: s.opts.Identity},
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to build leader election lock")
+	}
+
+	go s.watchConfigMap(ctx)
+	go s.stopOnContextDone(ctx)
+
+	electionConfig := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				s.setLeader(true)
+				s.runSyncLoop(ctx)
+			},
+			OnStoppedLeading: func() {
+				s.setLeader(false)
+			},
+		},
+	}
+
+	// RunOrDie returns once this replica loses the lease, so it is re-entered
+	// until ctx is cancelled to keep the replica a candidate.
+	go func() {
+		for ctx.Err() == nil {
+			leaderelection.RunOrDie(ctx, electionConfig)
+		}
+	}()
+
+	return nil
+}
+
+// Stop signals Start's background goroutines to exit, including cancelling
+// the context driving leaderelection.RunOrDie so a stopped Scheduler stops
+// renewing its Lease. Safe to call more than once.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		if s.cancel != nil {
+			s.cancel()
+		}
+		close(s.stopCh)
+	})
+}
+
+// stopOnContextDone calls Stop when ctx is cancelled, so watchConfigMap
+// (which only listens on stopCh, not ctx) gets torn down even if the caller
+// cancels the ctx passed to Start instead of calling Stop directly.
+func (s *Scheduler) stopOnContextDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.Stop()
+	case <-s.stopCh:
+	}
+}
+
+func (s *Scheduler) setLeader(leader bool) {
+	s.mu.Lock()
+	s.isLeader = leader
+	s.mu.Unlock()
+
+	if leader {
+		isLeaderGauge.Set(1)
+	} else {
+		isLeaderGauge.Set(0)
+	}
+}
+
+// runSyncLoop owns the leader's Azure Get-Operations calls: an initial sync,
+// a fast retry loop while it's failing, and a steady interval once healthy.
+// It returns when ctx is cancelled (i.e. leadership is lost).
+func (s *Scheduler) runSyncLoop(ctx context.Context) {
+	interval := s.opts.FastRetryInterval
+
+	for {
+		opMap, err := s.opts.Refresh(ctx)
+		if err != nil {
+			interval = s.opts.FastRetryInterval
+			klog.Errorf("job: OperationsMap sync failed, retrying in %s: %v", interval, err)
+		} else {
+			s.mu.Lock()
+			s.snapshot = opMap
+			s.mu.Unlock()
+
+			lastSuccessTimestamp.SetToCurrentTime()
+
+			if pubErr := s.publish(ctx, opMap); pubErr != nil {
+				klog.Errorf("job: Failed to publish OperationsMap to ConfigMap %s/%s: %v", s.opts.Namespace, s.opts.ConfigMapName, pubErr)
+			}
+
+			interval = s.opts.SteadyInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// publish writes opMap to the shared ConfigMap, annotated with a content
+// hash so followers can tell whether anything actually changed without
+// re-diffing the whole map. If the existing ConfigMap already carries the
+// same hash, publish leaves it untouched instead of writing an identical
+// ConfigMap every steady interval.
+func (s *Scheduler) publish(ctx context.Context, opMap azure.OperationsMap) error {
+	data, err := json.Marshal(opMap)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal OperationsMap")
+	}
+
+	hash := sha256.Sum256(data)
+	hashHex := hex.EncodeToString(hash[:])
+
+	cmClient := s.kubeclientset.CoreV1().ConfigMaps(s.opts.Namespace)
+
+	existing, err := cmClient.Get(ctx, s.opts.ConfigMapName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		if existing.Annotations[contentHashAnnotation] == hashHex {
+			return nil
+		}
+	case apierrors.IsNotFound(err):
+		existing = nil
+	default:
+		return errors.Wrap(err, "Failed to read existing OperationsMap ConfigMap")
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        s.opts.ConfigMapName,
+			Namespace:   s.opts.Namespace,
+			Annotations: map[string]string{contentHashAnnotation: hashHex},
+		},
+		Data: map[string]string{operationsMapDataKey: string(data)},
+	}
+
+	if existing == nil {
+		_, err = cmClient.Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		cm.ResourceVersion = existing.ResourceVersion
+		_, err = cmClient.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+
+	return errors.Wrap(err, "Failed to write OperationsMap ConfigMap")
+}
+
+// watchConfigMap keeps Scheduler's snapshot current while this replica is a
+// follower by watching the published ConfigMap and hot-reloading on change,
+// instead of hammering ARM from every replica. ConfigMap events are ignored
+// while this replica is leader, including before its own first sync has
+// completed; a leader keeps whatever snapshot it held until then.
+func (s *Scheduler) watchConfigMap(ctx context.Context) {
+	listWatch := cache.NewListWatchFromClient(
+		s.kubeclientset.CoreV1().RESTClient(),
+		"configmaps",
+		s.opts.Namespace,
+		fields.OneTermEqualSelector("metadata.name", s.opts.ConfigMapName),
+	)
+
+	_, controller := cache.NewInformer(listWatch, &corev1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { s.onConfigMapEvent(obj) },
+		UpdateFunc: func(oldObj, newObj interface{}) { s.onConfigMapEvent(newObj) },
+	})
+
+	controller.Run(s.stopCh)
+}
+
+func (s *Scheduler) onConfigMapEvent(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	leader := s.isLeader
+	s.mu.RUnlock()
+	if leader {
+		// The leader's snapshot is set only by its own syncs, which also
+		// publish this ConfigMap.
+		return
+	}
+
+	data, ok := cm.Data[operationsMapDataKey]
+	if !ok {
+		return
+	}
+
+	opMap := azure.NewOperationsMap()
+	if err := json.Unmarshal([]byte(data), &opMap); err != nil {
+		klog.Errorf("job: Failed to decode OperationsMap from ConfigMap %s/%s: %v", s.opts.Namespace, s.opts.ConfigMapName, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.snapshot = opMap
+	s.mu.Unlock()
+
+	lastSuccessTimestamp.SetToCurrentTime()
+
+	klog.V(5).Infof("job: Hot-reloaded OperationsMap from ConfigMap %s/%s (hash %s)", s.opts.Namespace, s.opts.ConfigMapName, cm.Annotations[contentHashAnnotation])
+}
@@ -0,0 +1,146 @@
+/*
+Copyright The Guard Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorclientset "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+)
+
+// DefaultCRDWildcardSegment is the path segment Azure publishes a catch-all
+// data action under for resources it can't enumerate individually, e.g.
+// "Microsoft.ContainerService/managedClusters/customResources/read".
+const DefaultCRDWildcardSegment = "customResources"
+
+// APISurfaceInfo records which API groups in a cluster are backed by CRDs or
+// by an aggregated API server, as opposed to a built-in group the apiserver
+// compiles in. createOperationsMap uses this to fall back to a wildcard data
+// action for resources Azure doesn't publish per-kind operations for.
+type APISurfaceInfo struct {
+	// CRDGroups is the set of API groups that have at least one
+	// CustomResourceDefinition registered.
+	CRDGroups map[string]bool
+	// AggregatedGroups is the set of API groups served by an aggregated API
+	// server (registered via an APIService with a non-empty Spec.Service).
+	AggregatedGroups map[string]bool
+}
+
+// IsExtension reports whether group is backed by a CRD or an aggregated API
+// server, i.e. isn't a built-in group the apiserver ships with.
+func (s APISurfaceInfo) IsExtension(group string) bool {
+	return s.CRDGroups[group] || s.AggregatedGroups[group]
+}
+
+// fetchAPISurfaceInfo enumerates CustomResourceDefinitions and APIServices to
+// determine which API groups are extensions rather than built in. A failure
+// to list either is non-fatal: DiscoverResources still returns data actions
+// for built-in resources, just without the CRD/aggregated wildcard fallback.
+func fetchAPISurfaceInfo(settings *DiscoverResourcesSettings) APISurfaceInfo {
+	surface := APISurfaceInfo{
+		CRDGroups:        make(map[string]bool),
+		AggregatedGroups: make(map[string]bool),
+	}
+
+	cfg, err := buildRestConfig(settings)
+	if err != nil {
+		klog.V(5).Infof("Skipping CRD/aggregated API detection: %v", err)
+		return surface
+	}
+
+	if crdClientset, err := apiextensionsclientset.NewForConfig(cfg); err != nil {
+		klog.V(5).Infof("Skipping CRD detection: %v", err)
+	} else {
+		crds, err := crdClientset.ApiextensionsV1().CustomResourceDefinitions().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			klog.V(5).Infof("Failed to list CustomResourceDefinitions: %v", err)
+		} else {
+			for _, crd := range crds.Items {
+				surface.CRDGroups[crd.Spec.Group] = true
+			}
+		}
+	}
+
+	if aggregatorClientset, err := aggregatorclientset.NewForConfig(cfg); err != nil {
+		klog.V(5).Infof("Skipping aggregated API detection: %v", err)
+	} else {
+		apiServices, err := aggregatorClientset.ApiregistrationV1().APIServices().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			klog.V(5).Infof("Failed to list APIServices: %v", err)
+		} else {
+			items := make([]*apiregistrationv1.APIService, len(apiServices.Items))
+			for i := range apiServices.Items {
+				items[i] = &apiServices.Items[i]
+			}
+			surface.AggregatedGroups = aggregatedGroupsFromAPIServices(items)
+		}
+	}
+
+	return surface
+}
+
+// aggregatedGroupsFromAPIServices builds the set of API groups served by an
+// aggregated API server (as opposed to a local CRD or built-in group) from a
+// list of APIServices. Only APIServices with a non-empty Spec.Service point
+// at an external server; the rest are the apiserver's own built-in groups
+// registered as local APIServices.
+func aggregatedGroupsFromAPIServices(apiServices []*apiregistrationv1.APIService) map[string]bool {
+	aggregatedGroups := make(map[string]bool)
+	for _, svc := range apiServices {
+		if svc.Spec.Service != nil {
+			aggregatedGroups[svc.Spec.Group] = true
+		}
+	}
+	return aggregatedGroups
+}
+
+// buildAPISurfaceInfoFromCRDs is used by DiscoveryManager, which already
+// keeps a live CRD informer running and shouldn't pay for a fresh LIST on
+// every rebuild.
+func buildAPISurfaceInfoFromCRDs(crds []*apiextensionsv1.CustomResourceDefinition, aggregatedGroups map[string]bool) APISurfaceInfo {
+	surface := APISurfaceInfo{
+		CRDGroups:        make(map[string]bool, len(crds)),
+		AggregatedGroups: aggregatedGroups,
+	}
+	if surface.AggregatedGroups == nil {
+		surface.AggregatedGroups = make(map[string]bool)
+	}
+
+	for _, crd := range crds {
+		surface.CRDGroups[crd.Spec.Group] = true
+	}
+
+	return surface
+}
+
+func buildRestConfig(settings *DiscoverResourcesSettings) (*rest.Config, error) {
+	if settings.kubeconfigFilePath != "" {
+		cfg, err := clientcmd.BuildConfigFromFlags("", settings.kubeconfigFilePath)
+		return cfg, errors.Wrap(err, "Error building kubeconfig")
+	}
+
+	cfg, err := rest.InClusterConfig()
+	return cfg, errors.Wrap(err, "Error building in-cluster config")
+}
@@ -0,0 +1,410 @@
+/*
+Copyright The Guard Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	stderrors "errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	aggregatorclientset "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+	aggregatorinformers "k8s.io/kube-aggregator/pkg/client/informers/externalversions"
+)
+
+const (
+	// DefaultAzureOperationsTTL is how long a fetched Azure operations list is
+	// considered fresh before DiscoveryManager refreshes it again.
+	DefaultAzureOperationsTTL = 15 * time.Minute
+
+	// DefaultAzureRefreshMinBackoff and DefaultAzureRefreshMaxBackoff bound the
+	// jittered backoff applied when Azure's Get-Operations endpoint answers
+	// with 429 or a 5xx status.
+	DefaultAzureRefreshMinBackoff = 5 * time.Second
+	DefaultAzureRefreshMaxBackoff = 2 * time.Minute
+
+	// crdRebuildDebounce is how long the CRD informer handlers wait for
+	// further events before triggering a rebuild, so a burst of CRD
+	// adds/updates/deletes (e.g. a controller's CRDs all installing at once)
+	// collapses into a single ServerPreferredResources LIST + rebuild instead
+	// of one per event.
+	crdRebuildDebounce = 2 * time.Second
+)
+
+var (
+	discoveryCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "guard_discovery_cache_hits_total",
+		Help: "Number of times a DiscoveryManager served the Azure operations list from cache.",
+	})
+
+	discoveryCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "guard_discovery_cache_misses_total",
+		Help: "Number of times a DiscoveryManager had to refetch the Azure operations list because the cache entry expired or was absent.",
+	})
+
+	discoveryRebuildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "guard_discovery_rebuilds_total",
+		Help: "Number of OperationsMap rebuilds performed by a DiscoveryManager, labelled by trigger.",
+	}, []string{"trigger"})
+
+	discoveryGroupEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "guard_discovery_group_entries",
+		Help: "Number of resource entries held in the OperationsMap for a given API group.",
+	}, []string{"group"})
+)
+
+func init() {
+	prometheus.MustRegister(discoveryCacheHits, discoveryCacheMisses, discoveryRebuildsTotal, discoveryGroupEntries)
+}
+
+// DiscoveryManager keeps an OperationsMap up to date for as long as it is
+// running. API resource changes (new CRDs, newly registered groups) are
+// picked up via a SharedInformerFactory and, after crdRebuildDebounce of
+// quiet, trigger a rebuild so a burst of CRD events collapses into one
+// ServerPreferredResources LIST instead of one per event; the Azure side of
+// the map is refreshed on azureRefreshInterval, with the last successful
+// response cached in a TTL store so concurrent rebuilds don't repeatedly hit
+// ARM.
+type DiscoveryManager struct {
+	settings                  *DiscoverResourcesSettings
+	kubeclientset             kubernetes.Interface
+	crdInformerFactory        apiextensionsinformers.SharedInformerFactory
+	aggregatorInformerFactory aggregatorinformers.SharedInformerFactory
+	azureRefreshInterval      time.Duration
+	azureOpsCache             cache.Store
+
+	mu       sync.RWMutex
+	snapshot OperationsMap
+
+	// crdChangedCh is signalled (non-blockingly) by the CRD informer event
+	// handlers; debounceCRDRebuilds coalesces a burst of signals into a
+	// single rebuild.
+	crdChangedCh chan string
+
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	doneCh    chan struct{}
+	crdDoneCh chan struct{}
+}
+
+// NewDiscoveryManager builds a DiscoveryManager for settings. restConfig is
+// used both for the discovery client (api-resources) and the informer
+// factory that watches for newly registered API groups/CRDs.
+func NewDiscoveryManager(settings *DiscoverResourcesSettings, restConfig *rest.Config, azureRefreshInterval time.Duration) (*DiscoveryManager, error) {
+	kubeclientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error building kubernetes clientset")
+	}
+
+	apiextensionsClientset, err := apiextensionsclientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error building apiextensions clientset")
+	}
+
+	aggregatorClientset, err := aggregatorclientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error building aggregator clientset")
+	}
+
+	if azureRefreshInterval <= 0 {
+		azureRefreshInterval = DefaultAzureOperationsTTL
+	}
+
+	return &DiscoveryManager{
+		settings:                  settings,
+		kubeclientset:             kubeclientset,
+		crdInformerFactory:        apiextensionsinformers.NewSharedInformerFactory(apiextensionsClientset, 10*time.Minute),
+		aggregatorInformerFactory: aggregatorinformers.NewSharedInformerFactory(aggregatorClientset, 10*time.Minute),
+		azureRefreshInterval:      azureRefreshInterval,
+		// The cache TTL is pinned to azureRefreshInterval itself (rather than
+		// DefaultAzureOperationsTTL) so a caller that configures a shorter
+		// refresh interval actually gets a fresh Azure fetch on every tick
+		// instead of serving a stale cache hit until a fixed 15m TTL expires.
+		azureOpsCache: cache.NewTTLStore(cachedOperationsKeyFunc, azureRefreshInterval),
+		snapshot:      NewOperationsMap(),
+		crdChangedCh:  make(chan string, 1),
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+		crdDoneCh:     make(chan struct{}),
+	}, nil
+}
+
+// Start performs an initial full rebuild and then keeps the OperationsMap
+// current in the background until ctx is cancelled or Stop is called. It
+// returns once the initial rebuild has completed.
+func (m *DiscoveryManager) Start(ctx context.Context) error {
+	// fetchCtx is cancelled as soon as stopCh is closed, whether that's via
+	// Stop() or via stopOnContextDone reacting to ctx being cancelled. Fetches
+	// and their backoff sleeps are keyed off fetchCtx rather than ctx directly
+	// so a Stop() call (not just a ctx cancellation) interrupts them promptly.
+	fetchCtx, cancelFetch := context.WithCancel(context.Background())
+	go func() {
+		<-m.stopCh
+		cancelFetch()
+	}()
+
+	if err := m.rebuild(fetchCtx, "initial"); err != nil {
+		return errors.Wrap(err, "Failed initial OperationsMap build")
+	}
+
+	// Rebuilding on apiResourcesList changes is driven off a CRD informer:
+	// a new or removed CustomResourceDefinition is the most common way a
+	// cluster's API surface changes between Azure refreshes.
+	crdInformer := m.crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Informer()
+	if _, err := crdInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { m.signalCRDChanged("crd-added") },
+		UpdateFunc: func(oldObj, newObj interface{}) { m.signalCRDChanged("crd-updated") },
+		DeleteFunc: func(obj interface{}) { m.signalCRDChanged("crd-deleted") },
+	}); err != nil {
+		return errors.Wrap(err, "Failed to register CRD event handler")
+	}
+
+	m.crdInformerFactory.Start(m.stopCh)
+	m.crdInformerFactory.WaitForCacheSync(m.stopCh)
+
+	// APIServices are only consulted to classify a group as aggregated for
+	// the wildcard fallback (see rebuild); they don't need their own event
+	// handler, since an aggregated group appearing or disappearing is rare
+	// and will be picked up on the next azure-interval or crd-changed rebuild.
+	m.aggregatorInformerFactory.Start(m.stopCh)
+	m.aggregatorInformerFactory.WaitForCacheSync(m.stopCh)
+
+	go m.runAzureRefreshLoop(ctx, fetchCtx)
+	go m.debounceCRDRebuilds(ctx, fetchCtx)
+	go m.stopOnContextDone(ctx)
+
+	return nil
+}
+
+// Stop shuts down the background informers and refresh loop and waits for
+// them to exit. Safe to call more than once, and safe to call even if ctx
+// (passed to Start) was cancelled instead: either one stops the informer
+// factories, which only ever listen on stopCh.
+func (m *DiscoveryManager) Stop() {
+	m.stopOnce.Do(func() { close(m.stopCh) })
+	<-m.doneCh
+	<-m.crdDoneCh
+}
+
+// stopOnContextDone closes stopCh when ctx is cancelled, so the
+// SharedInformerFactories (which only listen on stopCh, not ctx) get torn
+// down even if the caller cancels ctx instead of calling Stop.
+func (m *DiscoveryManager) stopOnContextDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		m.stopOnce.Do(func() { close(m.stopCh) })
+	case <-m.stopCh:
+	}
+}
+
+// Snapshot returns the current OperationsMap. The returned map must be
+// treated as read-only by the caller: it is shared with the manager's
+// internal state and may be swapped out from under a concurrent rebuild.
+func (m *DiscoveryManager) Snapshot() OperationsMap {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.snapshot
+}
+
+// signalCRDChanged records that trigger happened and wakes debounceCRDRebuilds
+// without blocking the informer's event delivery goroutine. Losing the
+// specific trigger name to a coalesced burst is fine: debounceCRDRebuilds
+// always rebuilds with trigger "crd-changed" once the burst settles.
+func (m *DiscoveryManager) signalCRDChanged(trigger string) {
+	select {
+	case m.crdChangedCh <- trigger:
+	default:
+	}
+}
+
+// debounceCRDRebuilds coalesces a burst of CRD add/update/delete events into
+// a single rebuild: it waits for crdRebuildDebounce of silence after the
+// first signal before triggering ServerPreferredResources + createOperationsMap,
+// so e.g. a controller installing a dozen CRDs at once only pays for one LIST.
+func (m *DiscoveryManager) debounceCRDRebuilds(ctx context.Context, fetchCtx context.Context) {
+	defer close(m.crdDoneCh)
+
+	var timer *time.Timer
+	var timerCh <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.stopCh:
+			return
+		case <-m.crdChangedCh:
+			if timer == nil {
+				timer = time.NewTimer(crdRebuildDebounce)
+			} else {
+				timer.Reset(crdRebuildDebounce)
+			}
+			timerCh = timer.C
+		case <-timerCh:
+			timerCh = nil
+			if err := m.rebuild(fetchCtx, "crd-changed"); err != nil {
+				klog.Errorf("Failed to rebuild OperationsMap after crd-changed: %v", err)
+			}
+		}
+	}
+}
+
+func (m *DiscoveryManager) runAzureRefreshLoop(ctx context.Context, fetchCtx context.Context) {
+	defer close(m.doneCh)
+
+	ticker := time.NewTicker(m.azureRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			if err := m.rebuild(fetchCtx, "azure-interval"); err != nil {
+				klog.Errorf("Failed to refresh OperationsMap from Azure: %v", err)
+			}
+		}
+	}
+}
+
+// rebuild fetches a fresh apiResourcesList, fetches (or reuses a cached,
+// unexpired) Azure operations list, and atomically swaps in the resulting
+// OperationsMap. ctx bounds the Azure fetch and its retry backoff, so a
+// Stop() call (via the fetchCtx built in Start) interrupts a rebuild that's
+// mid-backoff instead of making Stop wait it out.
+func (m *DiscoveryManager) rebuild(ctx context.Context, trigger string) error {
+	discoveryRebuildsTotal.WithLabelValues(trigger).Inc()
+
+	apiResourcesList, err := m.kubeclientset.Discovery().ServerPreferredResources()
+	if err != nil && len(apiResourcesList) == 0 {
+		return errors.Wrap(err, "Failed to fetch list of api-resources from apiserver")
+	}
+
+	operationsList, err := m.fetchAzureOperationsWithCache(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to fetch operations from Azure")
+	}
+
+	crds, err := m.crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Lister().List(labels.Everything())
+	if err != nil {
+		klog.Warningf("Failed to list CustomResourceDefinitions from informer cache: %v", err)
+	}
+
+	apiServices, err := m.aggregatorInformerFactory.Apiregistration().V1().APIServices().Lister().List(labels.Everything())
+	if err != nil {
+		klog.Warningf("Failed to list APIServices from informer cache: %v", err)
+	}
+
+	surface := buildAPISurfaceInfoFromCRDs(crds, aggregatedGroupsFromAPIServices(apiServices))
+
+	opMap := createOperationsMap(apiResourcesList, operationsList, m.settings.clusterType, surface, m.settings.crdWildcardSegment)
+
+	m.mu.Lock()
+	m.snapshot = opMap
+	m.mu.Unlock()
+
+	for group, resources := range opMap {
+		discoveryGroupEntries.WithLabelValues(group).Set(float64(len(resources)))
+	}
+
+	return nil
+}
+
+// fetchAzureOperationsWithCache returns the cached Azure operations list if
+// it hasn't expired, refetching it on a cache miss with jittered exponential
+// backoff on 429/5xx. The whole retry loop, including its backoff sleeps, is
+// bound to ctx, so cancelling ctx (e.g. via Stop) interrupts it immediately
+// instead of blocking for up to DefaultAzureRefreshMaxBackoff.
+func (m *DiscoveryManager) fetchAzureOperationsWithCache(ctx context.Context) ([]Operation, error) {
+	if item, exists, err := m.azureOpsCache.GetByKey(m.settings.operationsEndpoint); err == nil && exists {
+		discoveryCacheHits.Inc()
+		return item.(*cachedOperations).operations, nil
+	}
+
+	discoveryCacheMisses.Inc()
+
+	var operationsList []Operation
+
+	backoff := wait.Backoff{
+		Duration: DefaultAzureRefreshMinBackoff,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    math.MaxInt32,
+		Cap:      DefaultAzureRefreshMaxBackoff,
+	}
+
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		ops, err := fetchDataActionsList(ctx, m.settings)
+		if err != nil {
+			if isRetryableAzureError(err) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		operationsList = ops
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.azureOpsCache.Add(&cachedOperations{key: m.settings.operationsEndpoint, operations: operationsList}); err != nil {
+		klog.Warningf("Failed to cache Azure operations list: %v", err)
+	}
+
+	return operationsList, nil
+}
+
+// cachedOperations is the value type stored in azureOpsCache, keyed by the
+// Azure operations endpoint it was fetched from.
+type cachedOperations struct {
+	key        string
+	operations []Operation
+}
+
+func cachedOperationsKeyFunc(obj interface{}) (string, error) {
+	co, ok := obj.(*cachedOperations)
+	if !ok {
+		return "", errors.Errorf("expected *cachedOperations, got %T", obj)
+	}
+	return co.key, nil
+}
+
+func isRetryableAzureError(err error) bool {
+	var apiErr *AzureAPIError
+	if !stderrors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError
+}
@@ -17,17 +17,21 @@ limitations under the License.
 package azure
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"go.kubeguard.dev/guard/auth/providers/azure/graph"
+	azureauth "go.kubeguard.dev/guard/auth/providers/azure/tokensource"
 	"go.kubeguard.dev/guard/util/httpclient"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/go-autorest/autorest/azure"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
@@ -93,6 +97,65 @@ type DiscoverResourcesSettings struct {
 	tenantID           string
 	clientID           string
 	clientSecret       string
+	pageSize           int
+	totalTimeout       time.Duration
+	crdWildcardSegment string
+
+	credentialKind               azureauth.CredentialKind
+	userAssignedIdentityClientID string
+
+	tokenSourceOnce sync.Once
+	tokenSource     *azureauth.TokenSource
+	tokenSourceErr  error
+}
+
+const (
+	// DefaultOperationsPageSize is the $top page size requested on each
+	// Get-Operations call when the caller hasn't overridden it.
+	DefaultOperationsPageSize = 100
+
+	// DefaultOperationsTotalTimeout bounds one whole paginated Get-Operations
+	// fetch (all of its pages) so a stuck ARM endpoint can't hang
+	// DiscoverResources indefinitely.
+	DefaultOperationsTotalTimeout = 2 * time.Minute
+)
+
+// SetPageSize overrides the $top page size used when paging the Get-Operations
+// response. It is a no-op for size <= 0.
+func (s *DiscoverResourcesSettings) SetPageSize(size int) {
+	if size > 0 {
+		s.pageSize = size
+	}
+}
+
+// SetTotalTimeout overrides how long a full (all-pages) Get-Operations fetch
+// is allowed to take before it is aborted. It is a no-op for d <= 0.
+func (s *DiscoverResourcesSettings) SetTotalTimeout(d time.Duration) {
+	if d > 0 {
+		s.totalTimeout = d
+	}
+}
+
+// SetCRDWildcardSegment overrides the wildcard data action segment used for
+// resources served by a CRD or an aggregated API server, e.g. "customResources"
+// in "Microsoft.ContainerService/managedClusters/customResources/read". An
+// empty segment disables the wildcard fallback entirely.
+func (s *DiscoverResourcesSettings) SetCRDWildcardSegment(segment string) {
+	s.crdWildcardSegment = segment
+}
+
+// SetCredentialKind selects which azidentity credential acquires tokens for
+// the AKS/Fleet Get-Operations call. Defaults to azureauth.CredentialKindChained
+// (workload identity, falling back to managed identity) if never called.
+func (s *DiscoverResourcesSettings) SetCredentialKind(kind azureauth.CredentialKind) {
+	s.credentialKind = kind
+}
+
+// SetUserAssignedIdentityClientID selects a user-assigned managed identity
+// for CredentialKindManagedIdentity/CredentialKindChained; leave unset to use
+// the node's system-assigned identity.
+func (s *DiscoverResourcesSettings) SetUserAssignedIdentityClientID(clientID string) {
+	s.userAssignedIdentityClientID = clientID
 }
 
 type Display struct {
@@ -170,6 +233,9 @@ func NewDiscoverResourcesSettings(clusterType string, environment string, loginU
 		tenantID:           tenantID,
 		clientID:           clientID,
 		clientSecret:       clientSecret,
+		pageSize:           DefaultOperationsPageSize,
+		totalTimeout:       DefaultOperationsTotalTimeout,
+		crdWildcardSegment: DefaultCRDWildcardSegment,
 	}
 
 	env := azure.PublicCloud
@@ -217,7 +283,7 @@ func DiscoverResources(settings *DiscoverResourcesSettings) (OperationsMap, erro
 	discoverResourcesApiServerCallDuration.Observe(apiResourcesListDuration)
 
 	getOperationsStart := time.Now()
-	operationsList, err := fetchDataActionsList(settings)
+	operationsList, err := fetchDataActionsList(context.Background(), settings)
 	getOperationsDuration := time.Since(getOperationsStart).Seconds()
 
 	if err != nil {
@@ -226,14 +292,23 @@ func DiscoverResources(settings *DiscoverResourcesSettings) (OperationsMap, erro
 
 	discoverResourcesAzureCallDuration.Observe(getOperationsDuration)
 
-	operationsMap = createOperationsMap(apiResourcesList, operationsList, settings.clusterType)
+	surface := fetchAPISurfaceInfo(settings)
+
+	operationsMap = createOperationsMap(apiResourcesList, operationsList, settings.clusterType, surface, settings.crdWildcardSegment)
 
 	klog.V(5).Infof("Operations Map created for resources: %s", operationsMap)
 
 	return operationsMap, nil
 }
 
-func createOperationsMap(apiResourcesList []*metav1.APIResourceList, operationsList []Operation, clusterType string) OperationsMap {
+// createOperationsMap matches every namespaced-or-cluster-scoped APIResource
+// in apiResourcesList against operationsList to build the action map used by
+// checkaccess. Resources belonging to an extension group (CRDs, aggregated
+// API servers, per surface) that Azure doesn't publish a per-kind operation
+// for instead fall back to the wildcard data action under
+// "<clusterType>/<wildcardSegment>/*", e.g. Argo's Workflow or Istio's
+// VirtualService both resolve to "Microsoft.Kubernetes/connectedClusters/customResources/read".
+func createOperationsMap(apiResourcesList []*metav1.APIResourceList, operationsList []Operation, clusterType string, surface APISurfaceInfo, wildcardSegment string) OperationsMap {
 	operationsMap := NewOperationsMap()
 
 	for _, resList := range apiResourcesList {
@@ -251,64 +326,19 @@ func createOperationsMap(apiResourcesList []*metav1.APIResourceList, operationsL
 				continue
 			}
 
+			resourceName := apiResource.Name
+
 			actionId := clusterType
 			if group != "v1" {
 				actionId = path.Join(actionId, group)
 			}
-
-			resourceName := apiResource.Name
-
 			actionId = path.Join(actionId, resourceName)
 
-			for _, operation := range operationsList {
-				if strings.Contains(operation.Name, actionId) {
-					opNameArr := strings.Split(operation.Name, "/")
-
-					/* The strings.contains check will return true for groups that have same prefix. For example:
-					    Will return true for "Microsoft.ContainerService/managedCluster/events.k8s.io/events/.."
-						and Microsoft.ContainerService/managedCluster/mc/events/.."  when:
-						group = v1
-						resource = events
-						actionID = Microsoft.ContainerService/managedCluster/events/.."
-						Without the below validation , the dataactions for events in events.k8s.io will get added in v1 map as well which
-						will return the wrong data actions later in checkaccess
-						So we need extra validation to check whether the group / resource are equal.
-					*/
-					if group != "v1" {
-						// extra validation to make sure groups are the same
-						if group != opNameArr[2] {
-							continue
-						}
-					} else {
-						// make sure resources are the same for core apigroup
-						if resourceName != opNameArr[2] {
-							continue
-						}
-					}
-
-					verb := opNameArr[len(opNameArr)-1]
-					if verb == "action" {
-						verb = path.Join(opNameArr[len(opNameArr)-2], opNameArr[len(opNameArr)-1])
-					}
-
-					da := DataAction{
-						ActionInfo: AuthorizationActionInfo{
-							IsDataAction: true,
-						},
-						IsNamespacedResource: apiResource.Namespaced,
-					}
-					da.ActionInfo.AuthorizationEntity.Id = operation.Name
-
-					if _, found := operationsMap[group]; !found {
-						operationsMap[group] = NewResourceAndVerbMap()
-					}
-
-					if _, found := operationsMap[group][resourceName]; !found {
-						operationsMap[group][resourceName] = NewVerbAndActionsMap()
-					}
-
-					operationsMap[group][resourceName][verb] = da
-				}
+			matched := addMatchingDataActions(operationsMap, operationsList, actionId, group, group, resourceName, apiResource.Namespaced)
+
+			if !matched && wildcardSegment != "" && surface.IsExtension(group) {
+				wildcardActionId := path.Join(clusterType, wildcardSegment)
+				addMatchingDataActions(operationsMap, operationsList, wildcardActionId, wildcardSegment, group, resourceName, apiResource.Namespaced)
 			}
 		}
 	}
@@ -316,6 +346,73 @@ func createOperationsMap(apiResourcesList []*metav1.APIResourceList, operationsL
 	return operationsMap
 }
 
+// addMatchingDataActions finds every operation in operationsList whose name
+// matches actionId, validated against matchSegment (the group for a built-in
+// resource, or the wildcard segment for an extension falling back to a
+// catch-all), and records a DataAction for resourceName under storageGroup
+// (always the resource's real API group, so checkaccess can look it up by
+// the group it actually saw on the SAR). Returns whether at least one match
+// was added.
+func addMatchingDataActions(operationsMap OperationsMap, operationsList []Operation, actionId string, matchSegment string, storageGroup string, resourceName string, namespaced bool) bool {
+	matched := false
+
+	for _, operation := range operationsList {
+		if !strings.Contains(operation.Name, actionId) {
+			continue
+		}
+
+		opNameArr := strings.Split(operation.Name, "/")
+
+		/* The strings.contains check will return true for groups that have same prefix. For example:
+		    Will return true for "Microsoft.ContainerService/managedCluster/events.k8s.io/events/.."
+			and Microsoft.ContainerService/managedCluster/mc/events/.."  when:
+			group = v1
+			resource = events
+			actionID = Microsoft.ContainerService/managedCluster/events/.."
+			Without the below validation , the dataactions for events in events.k8s.io will get added in v1 map as well which
+			will return the wrong data actions later in checkaccess
+			So we need extra validation to check whether the group / resource are equal.
+		*/
+		if matchSegment != "v1" {
+			// extra validation to make sure groups (or the wildcard segment) are the same
+			if matchSegment != opNameArr[2] {
+				continue
+			}
+		} else {
+			// make sure resources are the same for core apigroup
+			if resourceName != opNameArr[2] {
+				continue
+			}
+		}
+
+		verb := opNameArr[len(opNameArr)-1]
+		if verb == "action" {
+			verb = path.Join(opNameArr[len(opNameArr)-2], opNameArr[len(opNameArr)-1])
+		}
+
+		da := DataAction{
+			ActionInfo: AuthorizationActionInfo{
+				IsDataAction: true,
+			},
+			IsNamespacedResource: namespaced,
+		}
+		da.ActionInfo.AuthorizationEntity.Id = operation.Name
+
+		if _, found := operationsMap[storageGroup]; !found {
+			operationsMap[storageGroup] = NewResourceAndVerbMap()
+		}
+
+		if _, found := operationsMap[storageGroup][resourceName]; !found {
+			operationsMap[storageGroup][resourceName] = NewVerbAndActionsMap()
+		}
+
+		operationsMap[storageGroup][resourceName][verb] = da
+		matched = true
+	}
+
+	return matched
+}
+
 func fetchApiResources(settings *DiscoverResourcesSettings) ([]*metav1.APIResourceList, error) {
 	// creates the in-cluster config
 	klog.V(5).Infof("Fetching list of APIResources from the apiserver.")
@@ -351,38 +448,147 @@ func fetchApiResources(settings *DiscoverResourcesSettings) ([]*metav1.APIResour
 	return apiresourcesList, nil
 }
 
-func fetchDataActionsList(settings *DiscoverResourcesSettings) ([]Operation, error) {
-	req, err := http.NewRequest(http.MethodGet, settings.operationsEndpoint, nil)
+// fetchDataActionsList fetches the full Get-Operations catalog for settings,
+// following NextLink until it is exhausted and deduplicating by
+// Operation.Name (the same operation can be repeated across pages). The
+// whole fetch, including every page, is bounded by settings.totalTimeout (on
+// top of whatever deadline or cancellation parentCtx already carries) so a
+// stuck ARM endpoint can't hang the caller indefinitely.
+func fetchDataActionsList(parentCtx context.Context, settings *DiscoverResourcesSettings) ([]Operation, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, settings.totalTimeout)
+	defer cancel()
+
+	token, err := acquireOperationsToken(ctx, settings)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create request for Get Operations call.")
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", fmt.Sprintf("guard-%s-%s-%s", v.Version.Platform, v.Version.GoVersion, v.Version.Version))
+	seen := make(map[string]struct{})
+	var finalOperations []Operation
+
+	nextURL := withPageSize(settings.operationsEndpoint, settings.pageSize)
+	for nextURL != "" {
+		operationsList, err := fetchOperationsPage(ctx, nextURL, token)
+		if err != nil {
+			return nil, err
+		}
 
-	var token string
-	if settings.clusterType == ConnectedClusters {
-		tokenProvider := graph.NewClientCredentialTokenProvider(settings.clientID, settings.clientSecret,
-			fmt.Sprintf("%s%s/oauth2/v2.0/token", settings.environment.ActiveDirectoryEndpoint, settings.tenantID),
-			fmt.Sprintf("%s/.default", settings.environment.ResourceManagerEndpoint))
+		for _, op := range operationsList.Value {
+			if _, dup := seen[op.Name]; dup {
+				continue
+			}
+			seen[op.Name] = struct{}{}
 
-		authResp, erro := tokenProvider.Acquire("")
-		if erro != nil {
-			return nil, errors.Wrap(erro, "Error getting authorization headers for Get Operations call.")
+			if op.IsDataAction != nil && *op.IsDataAction && strings.Contains(op.Name, settings.clusterType) {
+				finalOperations = append(finalOperations, op)
+			}
 		}
 
-		token = authResp.Token
-	} else { // AKS and Fleet
-		tokenProvider := graph.NewAKSTokenProvider(settings.aksLoginURL, settings.tenantID)
+		nextURL = operationsList.NextLink
+	}
 
-		authResp, err := tokenProvider.Acquire("")
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting authorization headers for Get Operations call.")
+	if klog.V(5).Enabled() {
+		printFinalOperations, _ := json.Marshal(finalOperations)
+
+		klog.Infof("List of Operations fetched from Azure %s", string(printFinalOperations))
+	}
+
+	return finalOperations, nil
+}
+
+// withPageSize appends a $top query parameter requesting pageSize items per
+// page; it is a no-op for pageSize <= 0.
+func withPageSize(endpoint string, pageSize int) string {
+	if pageSize <= 0 {
+		return endpoint
+	}
+
+	sep := "&"
+	if !strings.Contains(endpoint, "?") {
+		sep = "?"
+	}
+
+	return fmt.Sprintf("%s%s$top=%d", endpoint, sep, pageSize)
+}
+
+// acquireOperationsToken gets a bearer token suitable for the Get-Operations
+// call: a client secret credential for ARC clusters (guard already has a
+// clientID/clientSecret for those), and settings' configured azidentity
+// credential kind (workload identity, managed identity, or chained) for AKS
+// and Fleet. Tokens are acquired through an azureauth.TokenSource, which
+// caches the token and proactively refreshes it before it expires.
+func acquireOperationsToken(ctx context.Context, settings *DiscoverResourcesSettings) (string, error) {
+	ts, err := settings.getOrBuildTokenSource()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Error getting authorization headers for Get Operations call.")
+	}
+
+	return token, nil
+}
+
+// getOrBuildTokenSource lazily builds settings' azureauth.TokenSource on
+// first use and reuses it afterwards, so repeated Get-Operations calls (e.g.
+// from DiscoveryManager's refresh loop) share one cached/refreshed token
+// instead of re-authenticating every time.
+func (s *DiscoverResourcesSettings) getOrBuildTokenSource() (*azureauth.TokenSource, error) {
+	s.tokenSourceOnce.Do(func() {
+		scope := fmt.Sprintf("%s/.default", s.environment.ResourceManagerEndpoint)
+		clientOpts := policy.ClientOptions{}
+
+		if s.clusterType == ConnectedClusters {
+			cred, err := azidentity.NewClientSecretCredential(s.tenantID, s.clientID, s.clientSecret, &azidentity.ClientSecretCredentialOptions{
+				ClientOptions: clientOpts,
+			})
+			if err != nil {
+				s.tokenSourceErr = errors.Wrap(err, "Error building client secret credential")
+				return
+			}
+			s.tokenSource = azureauth.NewTokenSourceWithCredential(cred, "clientsecret", scope)
+			return
 		}
 
-		token = authResp.Token
+		// AKS and Fleet
+		s.tokenSource, s.tokenSourceErr = azureauth.NewTokenSource(azureauth.TokenSourceOptions{
+			CredentialKind:               s.credentialKind,
+			Scope:                        scope,
+			UserAssignedIdentityClientID: s.userAssignedIdentityClientID,
+			ClientOptions:                clientOpts,
+		})
+	})
+
+	return s.tokenSource, s.tokenSourceErr
+}
+
+// AzureAPIError records a non-200 response from an Azure ARM endpoint,
+// carrying the status code so callers (e.g. DiscoveryManager's retry
+// classification) can make retry decisions without string-matching the
+// wrapped error text.
+type AzureAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *AzureAPIError) Error() string {
+	return fmt.Sprintf("Request failed with status code: %d and response: %s", e.StatusCode, e.Body)
+}
+
+// fetchOperationsPage fetches and decodes a single page of the Get-Operations
+// response. The response body is streamed straight into the decoder rather
+// than buffered up front, since operations catalogs can run to several MB
+// once fully paginated.
+func fetchOperationsPage(ctx context.Context, pageURL string, token string) (*OperationList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create request for Get Operations call.")
 	}
 
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("guard-%s-%s-%s", v.Version.Platform, v.Version.GoVersion, v.Version.Version))
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	client := httpclient.DefaultHTTPClient
@@ -393,35 +599,77 @@ func fetchDataActionsList(settings *DiscoverResourcesSettings) ([]Operation, err
 	}
 	defer resp.Body.Close()
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error in reading response body")
-	}
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("Request failed with status code: %d and response: %s", resp.StatusCode, string(data))
+		data, _ := io.ReadAll(resp.Body)
+		return nil, &AzureAPIError{StatusCode: resp.StatusCode, Body: string(data)}
 	}
 
-	operationsList := OperationList{}
-	err = json.Unmarshal(data, &operationsList)
-	if err != nil {
+	operationsList := &OperationList{}
+	if err := json.NewDecoder(resp.Body).Decode(operationsList); err != nil {
 		return nil, errors.Wrap(err, "Failed to decode response")
 	}
 
-	var finalOperations []Operation
-	for _, op := range operationsList.Value {
-		if *op.IsDataAction && strings.Contains(op.Name, settings.clusterType) {
-			finalOperations = append(finalOperations, op)
-		}
+	return operationsList, nil
+}
+
+// DefaultMultiCloudWorkers bounds how many of the settingsList entries passed
+// to FetchDataActionsListForEnvironments are paginated concurrently.
+const DefaultMultiCloudWorkers = 4
+
+// fetchDataActionsListFn is the function FetchDataActionsListForEnvironments
+// calls per settingsList entry; overridden in tests so the merge/dedup/
+// error-propagation logic can be exercised without a real token source or
+// ARM endpoint.
+var fetchDataActionsListFn = fetchDataActionsList
+
+// FetchDataActionsListForEnvironments runs fetchDataActionsList against each
+// entry of settingsList concurrently, bounded by DefaultMultiCloudWorkers,
+// and returns the deduplicated union of every operation found. This is used
+// when guard needs the same cluster type's data actions across more than one
+// Azure cloud (e.g. public and a sovereign cloud) in a single discovery pass;
+// it is a standalone entry point for that multi-cloud case, not called from
+// the single-environment DiscoverResources/DiscoveryManager paths.
+func FetchDataActionsListForEnvironments(ctx context.Context, settingsList []*DiscoverResourcesSettings) ([]Operation, error) {
+	type result struct {
+		operations []Operation
+		err        error
 	}
 
-	if klog.V(5).Enabled() {
-		printFinalOperations, _ := json.Marshal(finalOperations)
+	results := make([]result, len(settingsList))
+	sem := make(chan struct{}, DefaultMultiCloudWorkers)
+	var wg sync.WaitGroup
 
-		klog.Infof("List of Operations fetched from Azure %s", string(printFinalOperations))
+	for i, settings := range settingsList {
+		wg.Add(1)
+		go func(i int, settings *DiscoverResourcesSettings) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ops, err := fetchDataActionsListFn(ctx, settings)
+			results[i] = result{operations: ops, err: err}
+		}(i, settings)
 	}
 
-	return finalOperations, nil
+	wg.Wait()
+
+	seen := make(map[string]struct{})
+	var merged []Operation
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		for _, op := range r.operations {
+			if _, dup := seen[op.Name]; dup {
+				continue
+			}
+			seen[op.Name] = struct{}{}
+			merged = append(merged, op)
+		}
+	}
+
+	return merged, nil
 }
 
 func init() {
@@ -0,0 +1,226 @@
+/*
+Copyright The Guard Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+// newMixedAPIResourcesList returns, via a fake discovery client, the kind of
+// ServerPreferredResources result a cluster with a mix of built-in, CRD-backed
+// and aggregated-API-server-backed resources would report: a core "v1" group,
+// a built-in "apps" group, a CRD group ("argoproj.io"), an aggregated group
+// ("metrics.k8s.io") and a built-in "batch" group with no matching operation.
+func newMixedAPIResourcesList() []*metav1.APIResourceList {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{{Name: "pods", Namespaced: true}},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Namespaced: true}},
+		},
+		{
+			GroupVersion: "argoproj.io/v1alpha1",
+			APIResources: []metav1.APIResource{{Name: "workflows", Namespaced: true}},
+		},
+		{
+			GroupVersion: "metrics.k8s.io/v1beta1",
+			APIResources: []metav1.APIResource{{Name: "pods", Namespaced: true}},
+		},
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []metav1.APIResource{{Name: "cronjobs", Namespaced: true}},
+		},
+	}
+
+	return fakeDiscovery.Resources
+}
+
+// newMixedAPISurfaceInfo builds an APISurfaceInfo the same way DiscoveryManager
+// does: from a CRD list and an APIService list, rather than hand-built maps.
+// argoproj.io is a CRD group, metrics.k8s.io is backed by an APIService with a
+// Service reference (aggregated), and "apps" is a local APIService (no
+// Service reference) and must not count as aggregated.
+func newMixedAPISurfaceInfo() APISurfaceInfo {
+	crds := []*apiextensionsv1.CustomResourceDefinition{
+		{Spec: apiextensionsv1.CustomResourceDefinitionSpec{Group: "argoproj.io"}},
+	}
+
+	apiServices := []*apiregistrationv1.APIService{
+		{
+			Spec: apiregistrationv1.APIServiceSpec{
+				Group:   "metrics.k8s.io",
+				Version: "v1beta1",
+				Service: &apiregistrationv1.ServiceReference{Name: "metrics-server", Namespace: "kube-system"},
+			},
+		},
+		{
+			Spec: apiregistrationv1.APIServiceSpec{Group: "apps", Version: "v1"},
+		},
+	}
+
+	return buildAPISurfaceInfoFromCRDs(crds, aggregatedGroupsFromAPIServices(apiServices))
+}
+
+func TestCreateOperationsMap_CoreCRDAndAggregatedResources(t *testing.T) {
+	apiResourcesList := newMixedAPIResourcesList()
+	surface := newMixedAPISurfaceInfo()
+
+	operationsList := []Operation{
+		{Name: "Microsoft.Kubernetes/connectedClusters/pods/read"},
+		{Name: "Microsoft.Kubernetes/connectedClusters/apps/deployments/read"},
+		{Name: "Microsoft.Kubernetes/connectedClusters/customResources/read"},
+	}
+
+	operationsMap := createOperationsMap(apiResourcesList, operationsList, ConnectedClusters, surface, DefaultCRDWildcardSegment)
+
+	if _, ok := operationsMap["v1"]["pods"]["read"]; !ok {
+		t.Errorf("expected a direct match for core resource pods/read, got %v", operationsMap["v1"])
+	}
+
+	if _, ok := operationsMap["apps"]["deployments"]["read"]; !ok {
+		t.Errorf("expected a direct match for apps/deployments/read, got %v", operationsMap["apps"])
+	}
+
+	if _, ok := operationsMap["argoproj.io"]["workflows"]["read"]; !ok {
+		t.Errorf("expected the CRD group argoproj.io/workflows to fall back to the wildcard data action, got %v", operationsMap["argoproj.io"])
+	}
+
+	if _, ok := operationsMap["metrics.k8s.io"]["pods"]["read"]; !ok {
+		t.Errorf("expected the aggregated group metrics.k8s.io/pods to fall back to the wildcard data action, got %v", operationsMap["metrics.k8s.io"])
+	}
+
+	if _, ok := operationsMap["batch"]; ok {
+		t.Errorf("batch is neither a built-in match nor an extension group, expected no entry, got %v", operationsMap["batch"])
+	}
+}
+
+func TestAddMatchingDataActions_DisambiguatesSimilarGroupPrefixes(t *testing.T) {
+	// Regression test for the prefix collision described in
+	// addMatchingDataActions's doc comment: an events resource in the core
+	// (v1) group must not match an operation for events.k8s.io, even though
+	// the operation name has "events" as a Contains substring match.
+	operationsList := []Operation{
+		{Name: "Microsoft.ContainerService/managedCluster/events.k8s.io/events/read"},
+		{Name: "Microsoft.ContainerService/managedCluster/events/read"},
+	}
+
+	operationsMap := NewOperationsMap()
+	actionId := "Microsoft.ContainerService/managedCluster/events"
+
+	matched := addMatchingDataActions(operationsMap, operationsList, actionId, "v1", "v1", "events", false)
+	if !matched {
+		t.Fatalf("expected a match for core events resource")
+	}
+
+	if _, ok := operationsMap["v1"]["events"]["read"]; !ok {
+		t.Fatalf("expected v1/events/read to be recorded, got %v", operationsMap["v1"])
+	}
+
+	if entry := operationsMap["v1"]["events"]["read"]; entry.ActionInfo.Id != "Microsoft.ContainerService/managedCluster/events/read" {
+		t.Errorf("expected the core events/read action, got the events.k8s.io one: %q", entry.ActionInfo.Id)
+	}
+}
+
+// stubFetchDataActionsListFn replaces fetchDataActionsListFn for the duration
+// of a test and restores the original on cleanup.
+func stubFetchDataActionsListFn(t *testing.T, fn func(ctx context.Context, settings *DiscoverResourcesSettings) ([]Operation, error)) {
+	t.Helper()
+
+	orig := fetchDataActionsListFn
+	fetchDataActionsListFn = fn
+	t.Cleanup(func() { fetchDataActionsListFn = orig })
+}
+
+func TestFetchDataActionsListForEnvironments_MergesAndDeduplicates(t *testing.T) {
+	public := &DiscoverResourcesSettings{operationsEndpoint: "public"}
+	sovereign := &DiscoverResourcesSettings{operationsEndpoint: "sovereign"}
+
+	var mu sync.Mutex
+	calledEndpoints := make(map[string]bool)
+
+	stubFetchDataActionsListFn(t, func(ctx context.Context, settings *DiscoverResourcesSettings) ([]Operation, error) {
+		mu.Lock()
+		calledEndpoints[settings.operationsEndpoint] = true
+		mu.Unlock()
+
+		switch settings.operationsEndpoint {
+		case "public":
+			return []Operation{{Name: "op/a"}, {Name: "op/b"}}, nil
+		case "sovereign":
+			return []Operation{{Name: "op/b"}, {Name: "op/c"}}, nil
+		default:
+			t.Fatalf("unexpected settings endpoint %q", settings.operationsEndpoint)
+			return nil, nil
+		}
+	})
+
+	merged, err := FetchDataActionsListForEnvironments(context.Background(), []*DiscoverResourcesSettings{public, sovereign})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !calledEndpoints["public"] || !calledEndpoints["sovereign"] {
+		t.Fatalf("expected both settings entries to be fetched, got %v", calledEndpoints)
+	}
+
+	gotNames := make(map[string]int)
+	for _, op := range merged {
+		gotNames[op.Name]++
+	}
+
+	want := map[string]int{"op/a": 1, "op/b": 1, "op/c": 1}
+	for name, count := range want {
+		if gotNames[name] != count {
+			t.Errorf("expected %q to appear %d time(s) in the merged result, got %d (%v)", name, count, gotNames[name], merged)
+		}
+	}
+	if len(merged) != len(want) {
+		t.Errorf("expected %d deduplicated operations, got %d: %v", len(want), len(merged), merged)
+	}
+}
+
+func TestFetchDataActionsListForEnvironments_PropagatesError(t *testing.T) {
+	public := &DiscoverResourcesSettings{operationsEndpoint: "public"}
+	sovereign := &DiscoverResourcesSettings{operationsEndpoint: "sovereign"}
+
+	wantErr := errors.New("sovereign cloud Get-Operations failed")
+
+	stubFetchDataActionsListFn(t, func(ctx context.Context, settings *DiscoverResourcesSettings) ([]Operation, error) {
+		if settings.operationsEndpoint == "sovereign" {
+			return nil, wantErr
+		}
+		return []Operation{{Name: "op/a"}}, nil
+	})
+
+	_, err := FetchDataActionsListForEnvironments(context.Background(), []*DiscoverResourcesSettings{public, sovereign})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("expected the sovereign cloud's error to propagate, got %v", err)
+	}
+}